@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/ossf/package-analysis/internal/log"
+)
+
+const (
+	// defaultHTTPAddr is used when OSSMALWARE_WORKER_HTTP_ADDR is unset.
+	defaultHTTPAddr = ":8080"
+	// defaultReadinessWindow is used when OSSMALWARE_WORKER_READINESS_WINDOW is unset or invalid.
+	defaultReadinessWindow = 5 * time.Minute
+)
+
+// healthServer backs the worker's /healthz, /readyz and /metrics endpoints.
+// /healthz reports ok as soon as main reaches the message loop. /readyz only
+// reports ok once the subscription and buckets are open and either no
+// sub.Receive has succeeded yet or the last one succeeded within
+// readinessWindow.
+type healthServer struct {
+	ready            int32 // atomic bool
+	lastReceiveNanos int64 // atomic unix nanos of the last successful sub.Receive
+	readinessWindow  time.Duration
+}
+
+func newHealthServer() *healthServer {
+	return &healthServer{readinessWindow: readinessWindow()}
+}
+
+// readinessWindow returns how long ago the last successful sub.Receive may
+// have been for /readyz to still report ready, read from
+// OSSMALWARE_WORKER_READINESS_WINDOW.
+func readinessWindow() time.Duration {
+	val := os.Getenv("OSSMALWARE_WORKER_READINESS_WINDOW")
+	if val == "" {
+		return defaultReadinessWindow
+	}
+
+	window, err := time.ParseDuration(val)
+	if err != nil || window <= 0 {
+		log.Warn("Invalid OSSMALWARE_WORKER_READINESS_WINDOW, using default",
+			log.Label("value", val))
+		return defaultReadinessWindow
+	}
+
+	return window
+}
+
+// markReady records that the subscription and buckets are open.
+func (h *healthServer) markReady() {
+	atomic.StoreInt32(&h.ready, 1)
+}
+
+// markReceived records that sub.Receive just succeeded.
+func (h *healthServer) markReceived() {
+	atomic.StoreInt64(&h.lastReceiveNanos, time.Now().UnixNano())
+}
+
+func (h *healthServer) isReady() bool {
+	if atomic.LoadInt32(&h.ready) == 0 {
+		return false
+	}
+
+	last := atomic.LoadInt64(&h.lastReceiveNanos)
+	if last == 0 {
+		// Open, but hasn't had a chance to receive a message yet.
+		return true
+	}
+
+	return time.Since(time.Unix(0, last)) <= h.readinessWindow
+}
+
+func (h *healthServer) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if !h.isReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.Handle("/metrics", promhttp.Handler())
+
+	return mux
+}
+
+// serveHealth starts the health/readiness/metrics HTTP server in the
+// background and stops it once ctx is done.
+func serveHealth(ctx context.Context, h *healthServer) {
+	addr := os.Getenv("OSSMALWARE_WORKER_HTTP_ADDR")
+	if addr == "" {
+		addr = defaultHTTPAddr
+	}
+
+	srv := &http.Server{Addr: addr, Handler: h.mux()}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		log.Info("Starting health and metrics server",
+			log.Label("addr", addr))
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("Health and metrics server failed",
+				"error", err)
+		}
+	}()
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"math"
 	"os"
+	"os/signal"
 	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"gocloud.dev/blob"
@@ -21,20 +23,183 @@ import (
 
 	"github.com/ossf/package-analysis/internal/analysis"
 	"github.com/ossf/package-analysis/internal/log"
+	"github.com/ossf/package-analysis/internal/metrics"
 	"github.com/ossf/package-analysis/internal/pkgecosystem"
+	"github.com/ossf/package-analysis/internal/pkgfetch"
 	"github.com/ossf/package-analysis/internal/resultstore"
+	"github.com/ossf/package-analysis/internal/retry"
 	"github.com/ossf/package-analysis/internal/sandbox"
 )
 
 const (
-	maxRetries    = 10
-	retryInterval = 1
-	retryExpRate  = 1.5
+	maxRetries = 10
 
 	localPkgPathFmt = "/local/%s"
+
+	// defaultWorkerConcurrency is used when OSSMALWARE_WORKER_CONCURRENCY is unset or invalid.
+	defaultWorkerConcurrency = 1
+	// defaultAnalysisTimeout is used when OSSMALWARE_WORKER_ANALYSIS_TIMEOUT is unset or invalid.
+	defaultAnalysisTimeout = 30 * time.Minute
+	// defaultFetchCacheDir is used when OSSMALWARE_WORKER_FETCH_CACHE_DIR is unset.
+	defaultFetchCacheDir = "/var/cache/package-analysis/fetch"
+	// defaultShutdownGracePeriod is used when OSSMALWARE_WORKER_SHUTDOWN_GRACE_PERIOD is unset or invalid.
+	defaultShutdownGracePeriod = 30 * time.Second
+	// shutdownCleanupTimeout bounds cleanup calls (closing the subscription,
+	// buckets and topics) made after the shutdown context has already been cancelled.
+	shutdownCleanupTimeout = 10 * time.Second
 )
 
-func handleMessage(ctx context.Context, msg *pubsub.Message, packagesBucket *blob.Bucket, resultsBucket, imageTag string) error {
+// connectionRetryPolicy governs reconnecting messageLoop after the subscription
+// itself fails (as opposed to a single message failing, see retryPolicy).
+var connectionRetryPolicy = retry.Policy{
+	MaxAttempts: maxRetries,
+	BaseDelay:   time.Second,
+	MaxDelay:    5 * time.Minute,
+}
+
+// analysisError associates an error with the phase of analysis during which
+// it occurred, so it can be recorded in dead-letter metadata.
+type analysisError struct {
+	phase string
+	err   error
+}
+
+func (e *analysisError) Error() string { return e.err.Error() }
+func (e *analysisError) Unwrap() error { return e.err }
+
+// phaseOutcome carries the result of running a package's analysis phases to
+// completion, so it can be handed back across the goroutine boundary in
+// runAnalysisPhases.
+type phaseOutcome struct {
+	results     map[string]*analysis.Result
+	finalStatus analysis.Status
+	lastPhase   string
+	err         error
+}
+
+// runAnalysisPhases runs fn, which should run every dynamic analysis phase
+// against an already-created sandbox and clean it up itself once done, in
+// the background, and returns its result. If ctx is done before fn returns
+// (the per-message analysis timeout firing on a stuck sandbox, for example),
+// it returns ctx.Err() immediately instead of blocking the caller: fn keeps
+// running, and whatever sandbox it owns is cleaned up whenever fn eventually
+// does return, however much later that turns out to be.
+func runAnalysisPhases(ctx context.Context, fn func() phaseOutcome) (phaseOutcome, error) {
+	done := make(chan phaseOutcome, 1)
+	go func() { done <- fn() }()
+
+	select {
+	case o := <-done:
+		return o, o.err
+	case <-ctx.Done():
+		return phaseOutcome{}, ctx.Err()
+	}
+}
+
+// retryPolicy returns the retry policy for processing a single message, built
+// from OSSMALWARE_WORKER_MAX_ATTEMPTS, OSSMALWARE_WORKER_RETRY_BASE_DELAY and
+// OSSMALWARE_WORKER_RETRY_MAX_DELAY, falling back to retry.DefaultPolicy for
+// any value that is unset or invalid.
+func retryPolicy() retry.Policy {
+	policy := retry.DefaultPolicy
+
+	if val := os.Getenv("OSSMALWARE_WORKER_MAX_ATTEMPTS"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			policy.MaxAttempts = n
+		} else {
+			log.Warn("Invalid OSSMALWARE_WORKER_MAX_ATTEMPTS, using default",
+				log.Label("value", val))
+		}
+	}
+
+	if val := os.Getenv("OSSMALWARE_WORKER_RETRY_BASE_DELAY"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			policy.BaseDelay = d
+		} else {
+			log.Warn("Invalid OSSMALWARE_WORKER_RETRY_BASE_DELAY, using default",
+				log.Label("value", val))
+		}
+	}
+
+	if val := os.Getenv("OSSMALWARE_WORKER_RETRY_MAX_DELAY"); val != "" {
+		if d, err := time.ParseDuration(val); err == nil && d > 0 {
+			policy.MaxDelay = d
+		} else {
+			log.Warn("Invalid OSSMALWARE_WORKER_RETRY_MAX_DELAY, using default",
+				log.Label("value", val))
+		}
+	}
+
+	return policy
+}
+
+// workerConcurrency returns the number of messages that may be processed concurrently,
+// read from OSSMALWARE_WORKER_CONCURRENCY.
+func workerConcurrency() int {
+	val := os.Getenv("OSSMALWARE_WORKER_CONCURRENCY")
+	if val == "" {
+		return defaultWorkerConcurrency
+	}
+
+	concurrency, err := strconv.Atoi(val)
+	if err != nil || concurrency <= 0 {
+		log.Warn("Invalid OSSMALWARE_WORKER_CONCURRENCY, using default",
+			log.Label("value", val),
+			log.Label("default", fmt.Sprint(defaultWorkerConcurrency)))
+		return defaultWorkerConcurrency
+	}
+
+	return concurrency
+}
+
+// fetchCacheDir returns the directory used to cache downloaded package
+// artifacts, read from OSSMALWARE_WORKER_FETCH_CACHE_DIR.
+func fetchCacheDir() string {
+	if val := os.Getenv("OSSMALWARE_WORKER_FETCH_CACHE_DIR"); val != "" {
+		return val
+	}
+	return defaultFetchCacheDir
+}
+
+// shutdownGracePeriod returns how long messageLoop waits for in-flight
+// analyses to finish on shutdown before giving up and Nacking them, read from
+// OSSMALWARE_WORKER_SHUTDOWN_GRACE_PERIOD.
+func shutdownGracePeriod() time.Duration {
+	val := os.Getenv("OSSMALWARE_WORKER_SHUTDOWN_GRACE_PERIOD")
+	if val == "" {
+		return defaultShutdownGracePeriod
+	}
+
+	grace, err := time.ParseDuration(val)
+	if err != nil || grace <= 0 {
+		log.Warn("Invalid OSSMALWARE_WORKER_SHUTDOWN_GRACE_PERIOD, using default",
+			log.Label("value", val))
+		return defaultShutdownGracePeriod
+	}
+
+	return grace
+}
+
+// analysisTimeout returns the maximum duration a single message may take to process,
+// read from OSSMALWARE_WORKER_ANALYSIS_TIMEOUT.
+func analysisTimeout() time.Duration {
+	val := os.Getenv("OSSMALWARE_WORKER_ANALYSIS_TIMEOUT")
+	if val == "" {
+		return defaultAnalysisTimeout
+	}
+
+	timeout, err := time.ParseDuration(val)
+	if err != nil || timeout <= 0 {
+		log.Warn("Invalid OSSMALWARE_WORKER_ANALYSIS_TIMEOUT, using default",
+			log.Label("value", val),
+			log.Label("default", defaultAnalysisTimeout.String()))
+		return defaultAnalysisTimeout
+	}
+
+	return timeout
+}
+
+func handleMessage(ctx context.Context, msg *pubsub.Message, fetcher *pkgfetch.Multi, resultsBucket, imageTag string) error {
 	name := msg.Metadata["name"]
 	if name == "" {
 		log.Warn("name is empty")
@@ -80,34 +245,46 @@ func handleMessage(ctx context.Context, msg *pubsub.Message, packagesBucket *blo
 		sandbox.Tag(imageTag),
 	}
 
-	if pkgPath != "" {
-		if packagesBucket == nil {
-			return errors.New("packages bucket not set")
-		}
+	// release checks a fetched artifact back into the cache; it stays a no-op
+	// when nothing is fetched.
+	release := func() {}
+	source := pkgfetch.Source(msg.Metadata["source"])
+	if source == "" && pkgPath != "" {
+		// Preserve existing behaviour for messages that predate the "source" field.
+		source = pkgfetch.SourceBlob
+	}
 
-		// Copy remote package path to temporary file.
-		r, err := packagesBucket.NewReader(ctx, pkgPath, nil)
-		if err != nil {
-			return err
+	if source != "" {
+		fetchURL := pkgPath
+		if fetchURL == "" {
+			fetchURL = msg.Metadata["url"]
 		}
-		defer r.Close()
 
-		f, err := ioutil.TempFile("", "")
+		localPath, releaseArtifact, err := fetcher.Fetch(ctx, pkgfetch.Request{
+			Source:    source,
+			Ecosystem: ecosystem,
+			Name:      name,
+			Version:   version,
+			URL:       fetchURL,
+			SHA256:    msg.Metadata["sha256"],
+			SHA512:    msg.Metadata["sha512"],
+		})
 		if err != nil {
-			return err
+			return fmt.Errorf("fetching package: %w", err)
 		}
-		defer os.Remove(f.Name())
+		// Keep the artifact checked out of the cache until the sandbox using
+		// it (created below) has been cleaned up, so a concurrent fetch for
+		// a different package can't evict it out from under the mount. The
+		// phase goroutine below releases it right after sb.Clean.
+		release = releaseArtifact
 
-		if _, err := io.Copy(f, r); err != nil {
-			return err
+		localName := fetchURL
+		if localName == "" {
+			localName = fmt.Sprintf("%s-%s", name, version)
 		}
 
-		if err := f.Close(); err != nil {
-			return err
-		}
-
-		localPkgPath = fmt.Sprintf(localPkgPathFmt, path.Base(pkgPath))
-		sbOpts = append(sbOpts, sandbox.Volume(f.Name(), localPkgPath))
+		localPkgPath = fmt.Sprintf(localPkgPathFmt, path.Base(localName))
+		sbOpts = append(sbOpts, sandbox.Volume(localPath, localPkgPath))
 	}
 
 	var pkg *pkgecosystem.Pkg
@@ -128,29 +305,54 @@ func handleMessage(ctx context.Context, msg *pubsub.Message, packagesBucket *blo
 	}
 
 	sb := sandbox.New(manager.Image(), sbOpts...)
-	defer sb.Clean()
-	results := make(map[string]*analysis.Result)
-	finalStatus := analysis.StatusCompleted
-	lastPhase := ""
-	for _, phase := range manager.DynamicPhases() {
-		result, err := analysis.Run(sb, pkg.Command(phase))
-		if err != nil {
-			log.Error("Analysis run failed",
+
+	outcome, err := runAnalysisPhases(ctx, func() phaseOutcome {
+		// Owns sb for as long as the phase loop runs, however long that
+		// turns out to be: if ctx fires first, runAnalysisPhases returns
+		// without waiting for us, and we still clean up sb ourselves once
+		// we're done with it rather than leaving that to a caller who may
+		// have already moved on. The fetched artifact is released only after
+		// sb.Clean, since the sandbox mounts it.
+		defer release()
+		defer sb.Clean()
+
+		results := make(map[string]*analysis.Result)
+		finalStatus := analysis.StatusCompleted
+		lastPhase := ""
+		for _, phase := range manager.DynamicPhases() {
+			phaseStart := time.Now()
+			result, err := analysis.Run(sb, pkg.Command(phase))
+			metrics.ObserveAnalysisPhaseDuration(ecosystem, phase, time.Since(phaseStart))
+			if err != nil {
+				log.Error("Analysis run failed",
+					log.Label("ecosystem", ecosystem),
+					log.Label("name", name),
+					log.Label("phase", phase),
+					log.Label("version", version),
+					"error", err)
+				return phaseOutcome{err: &analysisError{phase: phase, err: err}}
+			}
+			results[phase] = result
+			lastPhase = phase
+			finalStatus = result.Status
+			// Don't continue processing if the phase did not complete successfully.
+			if result.Status != analysis.StatusCompleted {
+				break
+			}
+		}
+		return phaseOutcome{results: results, finalStatus: finalStatus, lastPhase: lastPhase}
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Warn("Analysis timed out waiting on the sandbox; abandoning this attempt, cleanup will continue in the background",
 				log.Label("ecosystem", ecosystem),
 				log.Label("name", name),
-				log.Label("phase", phase),
-				log.Label("version", version),
-				"error", err)
-			return err
-		}
-		results[phase] = result
-		lastPhase = phase
-		finalStatus = result.Status
-		// Don't continue processing if the phase did not complete successfully.
-		if result.Status != analysis.StatusCompleted {
-			break
+				log.Label("version", version))
 		}
+		return err
 	}
+	results, finalStatus, lastPhase := outcome.results, outcome.finalStatus, outcome.lastPhase
+
 	// Produce a log message for the final status to help generate metrics.
 	switch finalStatus {
 	case analysis.StatusCompleted:
@@ -186,15 +388,136 @@ func handleMessage(ctx context.Context, msg *pubsub.Message, packagesBucket *blo
 		}
 	}
 
+	metrics.MessagesAcked.WithLabelValues(ecosystem, fmt.Sprint(finalStatus)).Inc()
 	msg.Ack()
 	return nil
 }
 
-func messageLoop(ctx context.Context, subURL, packagesBucket, resultsBucket, imageTag string) error {
+// deadLetter publishes msg to the dead-letter topic, carrying forward its
+// original metadata plus details of why it was abandoned, so operators can
+// triage it without the message poisoning the live subscription.
+func deadLetter(ctx context.Context, topic *pubsub.Topic, msg *pubsub.Message, attempts int, firstAttempt time.Time, cause error) error {
+	metadata := make(map[string]string, len(msg.Metadata)+4)
+	for k, v := range msg.Metadata {
+		metadata[k] = v
+	}
+	metadata["attempts"] = fmt.Sprint(attempts)
+	metadata["first_attempt_at"] = firstAttempt.UTC().Format(time.RFC3339)
+	metadata["last_attempt_at"] = time.Now().UTC().Format(time.RFC3339)
+	if cause != nil {
+		metadata["last_error"] = cause.Error()
+	}
+
+	var ae *analysisError
+	if errors.As(cause, &ae) {
+		metadata["phase"] = ae.phase
+	}
+
+	return topic.Send(ctx, &pubsub.Message{
+		Body:     msg.Body,
+		Metadata: metadata,
+	})
+}
+
+// inFlightMessages tracks messages currently being processed, so that on
+// shutdown any still outstanding once the grace period elapses can be Nacked
+// for redelivery instead of leaving the worker to wait on them indefinitely.
+type inFlightMessages struct {
+	mu   sync.Mutex
+	msgs map[*pubsub.Message]struct{}
+}
+
+func newInFlightMessages() *inFlightMessages {
+	return &inFlightMessages{msgs: make(map[*pubsub.Message]struct{})}
+}
+
+func (s *inFlightMessages) add(msg *pubsub.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.msgs[msg] = struct{}{}
+}
+
+func (s *inFlightMessages) remove(msg *pubsub.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.msgs, msg)
+}
+
+// nackAll Nacks every still-outstanding message so it is redelivered.
+func (s *inFlightMessages) nackAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for msg := range s.msgs {
+		msg.Nack()
+	}
+}
+
+// processMessage runs handleMessage according to policy, retrying transient
+// failures with backoff. If every attempt fails, the message (augmented with
+// failure details) is published to dlqTopic, if configured, and then Acked so
+// it does not poison the subscription.
+func processMessage(ctx context.Context, msg *pubsub.Message, fetcher *pkgfetch.Multi, resultsBucket, imageTag string, dlqTopic *pubsub.Topic, policy retry.Policy, timeout time.Duration) {
+	firstAttempt := time.Now()
+	var lastErr error
+
+	attempts, err := retry.Do(ctx, policy, func(attempt int) error {
+		msgCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		err := handleMessage(msgCtx, msg, fetcher, resultsBucket, imageTag)
+		if err != nil {
+			lastErr = err
+			log.Warn("Attempt failed",
+				log.Label("name", msg.Metadata["name"]),
+				log.Label("attempt", fmt.Sprint(attempt+1)),
+				log.Label("max_attempts", fmt.Sprint(policy.MaxAttempts)),
+				"error", err)
+		}
+		return err
+	})
+	if err == nil {
+		return
+	}
+
+	if ctx.Err() != nil {
+		// retry.Do was interrupted by shutdown rather than having genuinely
+		// exhausted its attempts: Nack so the message is redelivered instead
+		// of being treated as failed and lost (or needlessly dead-lettered).
+		log.Warn("Message processing interrupted by shutdown, nacking for redelivery",
+			log.Label("name", msg.Metadata["name"]),
+			log.Label("attempts", fmt.Sprint(attempts)),
+			"error", err)
+		msg.Nack()
+		return
+	}
+
+	log.Error("Giving up on message after exhausting retries",
+		log.Label("name", msg.Metadata["name"]),
+		log.Label("attempts", fmt.Sprint(attempts)),
+		"error", err)
+	metrics.MessagesFailed.WithLabelValues(msg.Metadata["ecosystem"]).Inc()
+
+	if dlqTopic != nil {
+		var dlqErr error
+		shutdownCleanup("dead-letter publish", func(dlqCtx context.Context) error {
+			dlqErr = deadLetter(dlqCtx, dlqTopic, msg, attempts, firstAttempt, lastErr)
+			return dlqErr
+		})
+		if dlqErr != nil {
+			msg.Nack()
+			return
+		}
+	}
+
+	msg.Ack()
+}
+
+func messageLoop(ctx context.Context, subURL, packagesBucket, resultsBucket, imageTag, dlqTopicURL string, hs *healthServer) error {
 	sub, err := pubsub.OpenSubscription(ctx, subURL)
 	if err != nil {
 		return err
 	}
+	defer shutdownCleanup("subscription", sub.Shutdown)
 
 	var pkgsBkt *blob.Bucket
 	if packagesBucket != "" {
@@ -203,31 +526,121 @@ func messageLoop(ctx context.Context, subURL, packagesBucket, resultsBucket, ima
 		if err != nil {
 			return err
 		}
-		defer pkgsBkt.Close()
+		defer func() { shutdownCleanup("packages bucket", func(context.Context) error { return pkgsBkt.Close() }) }()
+	}
+
+	var dlqTopic *pubsub.Topic
+	if dlqTopicURL != "" {
+		var err error
+		dlqTopic, err = pubsub.OpenTopic(ctx, dlqTopicURL)
+		if err != nil {
+			return err
+		}
+		defer shutdownCleanup("dead-letter topic", dlqTopic.Shutdown)
+	}
+
+	fetcher := pkgfetch.New(pkgsBkt, fetchCacheDir())
+	hs.markReady()
+
+	concurrency := workerConcurrency()
+	timeout := analysisTimeout()
+	policy := retryPolicy()
+	inFlight := newInFlightMessages()
+	var inFlightCount int64
+
+	msgs := make(chan *pubsub.Message, concurrency)
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for msg := range msgs {
+				n := atomic.AddInt64(&inFlightCount, 1)
+				metrics.AnalysesInFlight.Inc()
+				inFlight.add(msg)
+				processMessage(ctx, msg, fetcher, resultsBucket, imageTag, dlqTopic, policy, timeout)
+				inFlight.remove(msg)
+				metrics.AnalysesInFlight.Dec()
+				atomic.AddInt64(&inFlightCount, -1)
+				log.Debug("Message processed",
+					log.Label("in_flight", fmt.Sprint(n-1)))
+			}
+		}()
 	}
 
-	log.Info("Listening for messages to process...")
+	log.Info("Listening for messages to process...",
+		log.Label("concurrency", fmt.Sprint(concurrency)),
+		log.Label("analysis_timeout", timeout.String()))
+
 	for {
 		msg, err := sub.Receive(ctx)
 		if err != nil {
+			close(msgs)
+			drainWorkers(&workers, inFlight)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			// All subsequent receive calls will return the same error, so we bail out.
 			return fmt.Errorf("error receiving message: %w", err)
 		}
 
-		if err := handleMessage(ctx, msg, pkgsBkt, resultsBucket, imageTag); err != nil {
-			log.Error("Failed to process message",
-				"error", err)
-		}
+		metrics.MessagesReceived.Inc()
+		hs.markReceived()
+		msgs <- msg
+	}
+}
+
+// drainWorkers waits up to shutdownGracePeriod for every worker to finish the
+// message it is currently processing. If the grace period elapses first, it
+// Nacks whatever is still outstanding so it gets redelivered rather than
+// reprocessed by this worker, but it keeps waiting on workers after that:
+// each worker's current attempt is bounded by the per-message analysis
+// timeout, so it is guaranteed to return, and returning from drainWorkers
+// before it does would let main exit out from under a goroutine still inside
+// analysis.Run or the sandbox, before its deferred cleanup ever runs.
+func drainWorkers(workers *sync.WaitGroup, inFlight *inFlightMessages) {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	grace := shutdownGracePeriod()
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+		log.Warn("Shutdown grace period elapsed with analyses still in flight, nacking for redelivery",
+			log.Label("grace_period", grace.String()))
+		inFlight.nackAll()
+	}
+
+	<-done
+}
+
+// shutdownCleanup runs a cleanup function (closing a subscription, bucket or
+// topic) with a fresh, short-lived context, since by the time it runs the
+// message loop's own context may already be cancelled.
+func shutdownCleanup(what string, fn func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownCleanupTimeout)
+	defer cancel()
+
+	if err := fn(ctx); err != nil {
+		log.Error("Failed to clean up during shutdown",
+			log.Label("resource", what),
+			"error", err)
 	}
 }
 
 func main() {
 	retryCount := 0
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	subURL := os.Getenv("OSSMALWARE_WORKER_SUBSCRIPTION")
 	packagesBucket := os.Getenv("OSSF_MALWARE_ANALYSIS_PACKAGES")
 	resultsBucket := os.Getenv("OSSF_MALWARE_ANALYSIS_RESULTS")
 	imageTag := os.Getenv("OSSF_SANDBOX_IMAGE_TAG")
+	dlqTopicURL := os.Getenv("OSSMALWARE_WORKER_DLQ_TOPIC")
 	log.Initalize(os.Getenv("LOGGER_ENV"))
 	sandbox.InitEnv()
 
@@ -236,28 +649,38 @@ func main() {
 		log.Label("subscription", subURL),
 		log.Label("package_bucket", packagesBucket),
 		log.Label("results_bucket", resultsBucket),
-		log.Label("image_tag", imageTag))
+		log.Label("image_tag", imageTag),
+		log.Label("dlq_topic", dlqTopicURL))
+
+	hs := newHealthServer()
+	serveHealth(ctx, hs)
 
 	for {
-		err := messageLoop(ctx, subURL, packagesBucket, resultsBucket, imageTag)
-		if err != nil {
-			if retryCount++; retryCount >= maxRetries {
-				log.Error("Retries exceeded",
-					"error", err,
-					"retryCount", retryCount)
-				break
-			}
+		err := messageLoop(ctx, subURL, packagesBucket, resultsBucket, imageTag, dlqTopicURL, hs)
+		if err == nil {
+			continue
+		}
 
-			retryDuration := time.Second * time.Duration(retryDelay(retryCount))
-			log.Error("Error encountered, retrying",
+		if ctx.Err() != nil {
+			log.Info("Shutdown signal received, exiting",
+				"error", err)
+			break
+		}
+
+		if retryCount++; retryCount >= maxRetries {
+			log.Error("Retries exceeded",
 				"error", err,
-				"retryCount", retryCount,
-				"waitSeconds", retryDuration.Seconds())
-			time.Sleep(retryDuration)
+				"retryCount", retryCount)
+			break
 		}
-	}
-}
 
-func retryDelay(retryCount int) int {
-	return int(math.Floor(retryInterval * math.Pow(retryExpRate, float64(retryCount))))
+		retryDuration := connectionRetryPolicy.Delay(retryCount - 1)
+		metrics.RetryBackoffSeconds.Set(retryDuration.Seconds())
+		log.Error("Error encountered, retrying",
+			"error", err,
+			"retryCount", retryCount,
+			"waitSeconds", retryDuration.Seconds())
+		time.Sleep(retryDuration)
+		metrics.RetryBackoffSeconds.Set(0)
+	}
 }
@@ -0,0 +1,73 @@
+// Package metrics defines the Prometheus collectors exported by the worker.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "ossmalware_worker"
+
+var (
+	// MessagesReceived counts every message delivered by the subscription.
+	MessagesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_received_total",
+		Help:      "Total number of pubsub messages received.",
+	})
+
+	// MessagesAcked counts messages that completed analysis and were acked,
+	// broken down by ecosystem and terminal analysis.Status.
+	MessagesAcked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_acked_total",
+		Help:      "Total number of messages acked, by ecosystem and terminal analysis status.",
+	}, []string{"ecosystem", "status"})
+
+	// MessagesFailed counts messages that exhausted retries, by ecosystem.
+	MessagesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_failed_total",
+		Help:      "Total number of messages that exhausted retries, by ecosystem.",
+	}, []string{"ecosystem"})
+
+	// AnalysisPhaseDuration records how long each analysis phase took.
+	AnalysisPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "analysis_phase_duration_seconds",
+		Help:      "Duration of each analysis phase, by ecosystem and phase.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"ecosystem", "phase"})
+
+	// AnalysesInFlight is the number of analyses currently being processed.
+	AnalysesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "analyses_in_flight",
+		Help:      "Number of analyses currently being processed.",
+	})
+
+	// RetryBackoffSeconds is the backoff currently being waited out by the
+	// subscription reconnect loop, or 0 if it is not backing off.
+	RetryBackoffSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "retry_backoff_seconds",
+		Help:      "Current backoff duration of the subscription retry loop, in seconds.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		MessagesReceived,
+		MessagesAcked,
+		MessagesFailed,
+		AnalysisPhaseDuration,
+		AnalysesInFlight,
+		RetryBackoffSeconds,
+	)
+}
+
+// ObserveAnalysisPhaseDuration records how long a single analysis phase took.
+func ObserveAnalysisPhaseDuration(ecosystem, phase string, d time.Duration) {
+	AnalysisPhaseDuration.WithLabelValues(ecosystem, phase).Observe(d.Seconds())
+}
@@ -0,0 +1,33 @@
+package pkgfetch
+
+import (
+	"context"
+	"errors"
+
+	"gocloud.dev/blob"
+)
+
+// blobFetcher fetches artifacts stored at req.URL (the blob key) in a
+// gocloud.dev/blob bucket. This is the original, and still default, way the
+// worker receives package artifacts.
+type blobFetcher struct {
+	bucket *blob.Bucket
+}
+
+func (f *blobFetcher) Fetch(ctx context.Context, req Request) (string, string, string, error) {
+	if f.bucket == nil {
+		return "", "", "", errors.New("pkgfetch: packages bucket not set")
+	}
+
+	r, err := f.bucket.NewReader(ctx, req.URL, nil)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer r.Close()
+
+	path, err := copyToTemp(r)
+	if err != nil {
+		return "", "", "", err
+	}
+	return path, "", "", nil
+}
@@ -0,0 +1,121 @@
+package pkgfetch
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Cache is an on-disk LRU cache of downloaded package artifacts, keyed by
+// ecosystem, name, version and content digest. Entries are reference
+// counted: both Path (on a hit) and Put check an entry out on the caller's
+// behalf, and it is never evicted while checked out. Callers must call
+// Release once they are done using the path, since until then it may still
+// be mounted into a running sandbox.
+type Cache struct {
+	dir      string
+	maxItems int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key      string
+	path     string
+	refCount int
+}
+
+// NewCache returns a Cache that stores artifacts under dir, evicting the
+// least recently used entry once more than maxItems are cached.
+func NewCache(dir string, maxItems int) *Cache {
+	return &Cache{
+		dir:      dir,
+		maxItems: maxItems,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func cacheKey(ecosystem, name, version, digest string) string {
+	return strings.Join([]string{ecosystem, name, version, digest}, "/")
+}
+
+// Path returns the cached path for key, and whether it was found. A hit
+// checks the entry out, as Put does for a newly cached one; the caller must
+// call Release once it is done using the path.
+func (c *Cache) Path(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	entry := elem.Value.(*cacheEntry)
+	entry.refCount++
+	return entry.path, true
+}
+
+// ArtifactPath returns the on-disk path the cache would use for key, creating
+// the cache directory if it doesn't already exist.
+func (c *Cache) ArtifactPath(key string) (string, error) {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])), nil
+}
+
+// Put registers path, which must already exist on disk under dir, as the
+// cached artifact for key, checking it out on the caller's behalf the same
+// way a Path hit does, and evicts the least recently used entry not
+// currently checked out if the cache is now over capacity. The caller must
+// call Release once it is done using the path.
+func (c *Cache) Put(key, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.MoveToFront(elem)
+		entry := elem.Value.(*cacheEntry)
+		entry.path = path
+		entry.refCount++
+		return
+	}
+
+	elem := c.order.PushFront(&cacheEntry{key: key, path: path, refCount: 1})
+	c.entries[key] = elem
+
+	for e := c.order.Back(); c.order.Len() > c.maxItems && e != nil; {
+		prev := e.Prev()
+		entry := e.Value.(*cacheEntry)
+		if entry.refCount == 0 {
+			os.Remove(entry.path)
+			delete(c.entries, entry.key)
+			c.order.Remove(e)
+		}
+		e = prev
+	}
+}
+
+// Release checks key back in. Once nothing holds a checkout on an entry, it
+// becomes eligible for eviction again.
+func (c *Cache) Release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	if entry := elem.Value.(*cacheEntry); entry.refCount > 0 {
+		entry.refCount--
+	}
+}
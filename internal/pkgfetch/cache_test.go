@@ -0,0 +1,134 @@
+package pkgfetch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func touch(t *testing.T, path string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte("data"), 0o644); err != nil {
+		t.Fatalf("os.WriteFile(%s) failed: %v", path, err)
+	}
+}
+
+func TestCacheArtifactPathDeterministic(t *testing.T) {
+	c := NewCache(t.TempDir(), 10)
+
+	p1, err := c.ArtifactPath("npm/left-pad/1.0.0/deadbeef")
+	if err != nil {
+		t.Fatalf("ArtifactPath() error = %v", err)
+	}
+	p2, err := c.ArtifactPath("npm/left-pad/1.0.0/deadbeef")
+	if err != nil {
+		t.Fatalf("ArtifactPath() error = %v", err)
+	}
+	if p1 != p2 {
+		t.Errorf("ArtifactPath() = %s, %s, want equal for the same key", p1, p2)
+	}
+
+	p3, err := c.ArtifactPath("npm/left-pad/1.0.1/deadbeef")
+	if err != nil {
+		t.Fatalf("ArtifactPath() error = %v", err)
+	}
+	if p1 == p3 {
+		t.Errorf("ArtifactPath() returned the same path for different keys")
+	}
+}
+
+func TestCachePutAndPath(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(dir, 10)
+
+	path := filepath.Join(dir, "artifact")
+	touch(t, path)
+
+	c.Put("key", path)
+
+	got, ok := c.Path("key")
+	if !ok {
+		t.Fatal("Path() ok = false, want true")
+	}
+	if got != path {
+		t.Errorf("Path() = %s, want %s", got, path)
+	}
+
+	if _, ok := c.Path("missing"); ok {
+		t.Error("Path() ok = true for a key that was never Put")
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(dir, 2)
+
+	pathA, pathB, pathC := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+	touch(t, pathA)
+	touch(t, pathB)
+	touch(t, pathC)
+
+	c.Put("a", pathA)
+	c.Release("a")
+	c.Put("b", pathB)
+	c.Release("b")
+
+	// Touch "a" so "b" becomes the least recently used.
+	if _, ok := c.Path("a"); !ok {
+		t.Fatal("Path(a) ok = false")
+	}
+	c.Release("a")
+
+	c.Put("c", pathC)
+	c.Release("c")
+
+	if _, ok := c.Path("b"); ok {
+		t.Error("Path(b) ok = true, want b to have been evicted")
+	}
+	if _, err := os.Stat(pathB); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(pathB) error = %v, want not-exist", err)
+	}
+
+	if _, ok := c.Path("a"); !ok {
+		t.Error("Path(a) ok = false, want a to still be cached")
+	}
+	if _, ok := c.Path("c"); !ok {
+		t.Error("Path(c) ok = false, want c to still be cached")
+	}
+}
+
+func TestCacheDoesNotEvictCheckedOutEntry(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(dir, 1)
+
+	pathA, pathB := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	touch(t, pathA)
+	touch(t, pathB)
+
+	c.Put("a", pathA)
+	// Deliberately don't Release "a": simulates it still being mounted into
+	// a running sandbox.
+
+	c.Put("b", pathB)
+	c.Release("b")
+
+	if _, ok := c.Path("a"); !ok {
+		t.Error("Path(a) ok = false, want a to survive eviction while checked out")
+	}
+	if _, err := os.Stat(pathA); err != nil {
+		t.Errorf("os.Stat(pathA) error = %v, want the file to still exist", err)
+	}
+
+	// Once released, "a" becomes eligible for eviction on the next Put.
+	c.Release("a")
+	c.Release("a") // balances the extra checkout from the Path() call above.
+
+	pathD := filepath.Join(dir, "d")
+	touch(t, pathD)
+	c.Put("d", pathD)
+	c.Release("d")
+
+	if _, ok := c.Path("a"); ok {
+		t.Error("Path(a) ok = true, want a to have been evicted once released")
+	}
+}
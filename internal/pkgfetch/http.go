@@ -0,0 +1,54 @@
+package pkgfetch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// httpFetcher fetches artifacts directly from a plain HTTP(S) URL.
+type httpFetcher struct {
+	client *http.Client
+}
+
+func (f *httpFetcher) Fetch(ctx context.Context, req Request) (string, string, string, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL, nil)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	resp, err := f.client.Do(httpReq)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", "", fmt.Errorf("pkgfetch: fetching %s: unexpected status %s", req.URL, resp.Status)
+	}
+
+	path, err := copyToTemp(resp.Body)
+	if err != nil {
+		return "", "", "", err
+	}
+	return path, "", "", nil
+}
+
+// copyToTemp copies r to a new temporary file and returns its path.
+func copyToTemp(r io.Reader) (string, error) {
+	f, err := ioutil.TempFile("", "pkgfetch-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
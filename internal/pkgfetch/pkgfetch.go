@@ -0,0 +1,212 @@
+// Package pkgfetch downloads package artifacts for analysis from a number of
+// sources (a blob bucket, a plain HTTP(S) URL, or directly from the package's
+// own registry), verifying checksums where available and caching artifacts on
+// disk so repeat requests for the same package skip the download entirely.
+package pkgfetch
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+
+	"gocloud.dev/blob"
+)
+
+// defaultCacheSize is the number of artifacts kept on disk per Multi.
+const defaultCacheSize = 256
+
+// Source identifies where a package artifact should be fetched from.
+type Source string
+
+const (
+	SourceBlob     Source = "blob"
+	SourceHTTP     Source = "http"
+	SourceRegistry Source = "registry"
+)
+
+// Request describes a single package artifact to fetch.
+type Request struct {
+	Source    Source
+	Ecosystem string
+	Name      string
+	Version   string
+	// URL is the blob bucket key for SourceBlob, or the artifact URL for
+	// SourceHTTP. It is ignored for SourceRegistry, which resolves the URL
+	// itself from the package's public registry.
+	URL string
+	// SHA256 and SHA512 are the expected digests from registry metadata, if
+	// available. At most one needs to be set; SHA256 takes precedence.
+	SHA256 string
+	SHA512 string
+}
+
+// Fetcher downloads the artifact described by req to local disk, returning
+// its path. The returned file is owned by the caller. sha256Hex/sha512Hex
+// are the digest the source itself discovered for the artifact, if any (for
+// example, SourceRegistry resolving it from registry metadata); they are
+// empty when the source has no opinion and req's own digest, if any, should
+// be trusted instead.
+type Fetcher interface {
+	Fetch(ctx context.Context, req Request) (path, sha256Hex, sha512Hex string, err error)
+}
+
+// Resolver is implemented by Fetchers that can cheaply determine a request's
+// download URL and digest without downloading the artifact itself, so Multi
+// can check its cache before paying for the download. SourceBlob and
+// SourceHTTP requests already carry their own URL and, where the caller
+// knows it, digest; SourceRegistry is the one source that needs to ask the
+// registry first to find out either.
+type Resolver interface {
+	Resolve(ctx context.Context, req Request) (url, sha256Hex, sha512Hex string, err error)
+}
+
+// Multi dispatches Fetch to the Fetcher registered for a request's Source,
+// and caches results on disk keyed by ecosystem, name, version and digest.
+type Multi struct {
+	fetchers map[Source]Fetcher
+	cache    *Cache
+}
+
+// New returns a Multi with the standard blob, http and registry fetchers
+// registered. packagesBucket may be nil if SourceBlob requests are never
+// expected. cacheDir is created on first use.
+func New(packagesBucket *blob.Bucket, cacheDir string) *Multi {
+	client := http.DefaultClient
+	return &Multi{
+		fetchers: map[Source]Fetcher{
+			SourceBlob:     &blobFetcher{bucket: packagesBucket},
+			SourceHTTP:     &httpFetcher{client: client},
+			SourceRegistry: &registryFetcher{client: client},
+		},
+		cache: NewCache(cacheDir, defaultCacheSize),
+	}
+}
+
+// Fetch downloads the artifact described by req, skipping the download if a
+// matching digest is already cached on disk. If the Fetcher supports
+// resolving cheaply (as SourceRegistry does), Fetch first asks it to Resolve
+// the URL and digest, whether or not req already carries a digest; a digest
+// in req takes precedence over the resolved one. This lets a cache hit skip
+// the download entirely rather than only skipping the subsequent checksum
+// re-verification.
+//
+// Fetch checks the returned artifact out of the cache so a concurrent Fetch
+// for a different package cannot evict it while it is still in use (e.g.
+// mounted into a running sandbox); the caller must call the returned release
+// func once it is done using the path.
+func (m *Multi) Fetch(ctx context.Context, req Request) (string, func(), error) {
+	fetcher, ok := m.fetchers[req.Source]
+	if !ok {
+		return "", nil, fmt.Errorf("pkgfetch: no fetcher registered for source %q", req.Source)
+	}
+
+	if resolver, ok := fetcher.(Resolver); ok {
+		url, sha256Hex, sha512Hex, err := resolver.Resolve(ctx, req)
+		if err != nil {
+			return "", nil, err
+		}
+		req.URL = url
+		if req.SHA256 == "" {
+			req.SHA256 = sha256Hex
+		}
+		if req.SHA512 == "" {
+			req.SHA512 = sha512Hex
+		}
+	}
+
+	digest := req.SHA256
+	if digest == "" {
+		digest = req.SHA512
+	}
+
+	if digest != "" {
+		key := cacheKey(req.Ecosystem, req.Name, req.Version, digest)
+		if path, ok := m.cache.Path(key); ok {
+			if _, err := os.Stat(path); err == nil {
+				return path, func() { m.cache.Release(key) }, nil
+			}
+			// Entry is stale (its file is gone); check it back in and
+			// re-fetch as if it had been a miss.
+			m.cache.Release(key)
+		}
+	}
+
+	path, discoveredSHA256, discoveredSHA512, err := fetcher.Fetch(ctx, req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sha256Hex := req.SHA256
+	if sha256Hex == "" {
+		sha256Hex = discoveredSHA256
+	}
+	sha512Hex := req.SHA512
+	if sha512Hex == "" {
+		sha512Hex = discoveredSHA512
+	}
+
+	if err := verifyChecksum(path, sha256Hex, sha512Hex); err != nil {
+		os.Remove(path)
+		return "", nil, err
+	}
+
+	var key string
+	if sha256Hex != "" {
+		key = cacheKey(req.Ecosystem, req.Name, req.Version, sha256Hex)
+	} else if sha512Hex != "" {
+		key = cacheKey(req.Ecosystem, req.Name, req.Version, sha512Hex)
+	}
+
+	if key == "" {
+		// No digest to key the cache by: this artifact can't be shared with
+		// a future fetch, so clean it up once the caller releases it.
+		return path, func() { os.Remove(path) }, nil
+	}
+
+	if cachedPath, cacheErr := m.cache.ArtifactPath(key); cacheErr == nil {
+		if err := os.Rename(path, cachedPath); err == nil {
+			path = cachedPath
+		}
+	}
+	m.cache.Put(key, path)
+
+	return path, func() { m.cache.Release(key) }, nil
+}
+
+// verifyChecksum checks path against whichever of sha256Hex/sha512Hex is set.
+// It is a no-op if neither is set, since not every registry exposes digests.
+func verifyChecksum(path, sha256Hex, sha512Hex string) error {
+	if sha256Hex == "" && sha512Hex == "" {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var h hash.Hash
+	var want string
+	if sha256Hex != "" {
+		h, want = sha256.New(), sha256Hex
+	} else {
+		h, want = sha512.New(), sha512Hex
+	}
+
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("pkgfetch: checksum mismatch for %s: got %s, want %s", path, got, want)
+	}
+
+	return nil
+}
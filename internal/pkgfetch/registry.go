@@ -0,0 +1,148 @@
+package pkgfetch
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// registryFetcher resolves the download URL for name@version, and the
+// digest the registry advertises for it where available (npm dist.integrity,
+// PyPI digests, etc.), directly from the package's own public registry, then
+// downloads it the same way httpFetcher would. Resolving the digest here
+// matters because this is the one source where the worker itself, rather
+// than the pubsub message, is responsible for knowing what the artifact
+// should look like.
+type registryFetcher struct {
+	client *http.Client
+}
+
+// Resolve looks up the download URL and, where the registry publishes one,
+// the digest for req.Name@req.Version, without downloading the artifact
+// itself, so Multi can check its cache before paying for the download.
+func (f *registryFetcher) Resolve(ctx context.Context, req Request) (url, sha256Hex, sha512Hex string, err error) {
+	switch req.Ecosystem {
+	case "npm":
+		url, sha512Hex, err = f.resolveNPM(ctx, req.Name, req.Version)
+		return url, "", sha512Hex, err
+	case "pypi":
+		url, sha256Hex, err = f.resolvePyPI(ctx, req.Name, req.Version)
+		return url, sha256Hex, "", err
+	default:
+		return "", "", "", fmt.Errorf("pkgfetch: registry resolution not supported for ecosystem %q", req.Ecosystem)
+	}
+}
+
+func (f *registryFetcher) Fetch(ctx context.Context, req Request) (string, string, string, error) {
+	url, sha256Hex, sha512Hex := req.URL, req.SHA256, req.SHA512
+	if url == "" {
+		// Fall back to resolving here too, in case Fetch is ever called
+		// without going through Multi's Resolve step first.
+		var err error
+		url, sha256Hex, sha512Hex, err = f.Resolve(ctx, req)
+		if err != nil {
+			return "", "", "", err
+		}
+	}
+
+	path, _, _, err := (&httpFetcher{client: f.client}).Fetch(ctx, Request{URL: url})
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return path, sha256Hex, sha512Hex, nil
+}
+
+// resolveNPM looks up name@version on the public npm registry, returning its
+// tarball URL and, where published, a sha512 digest decoded from the
+// package's Subresource Integrity string.
+func (f *registryFetcher) resolveNPM(ctx context.Context, name, version string) (url, sha512Hex string, err error) {
+	var meta struct {
+		Dist struct {
+			Tarball   string `json:"tarball"`
+			Integrity string `json:"integrity"`
+		} `json:"dist"`
+	}
+
+	if err := f.getJSON(ctx, fmt.Sprintf("https://registry.npmjs.org/%s/%s", name, version), &meta); err != nil {
+		return "", "", err
+	}
+	if meta.Dist.Tarball == "" {
+		return "", "", fmt.Errorf("pkgfetch: no tarball found for npm package %s@%s", name, version)
+	}
+
+	return meta.Dist.Tarball, npmIntegritySHA512(meta.Dist.Integrity), nil
+}
+
+// resolvePyPI looks up name@version on PyPI, returning the sdist's URL and
+// published sha256 digest if one is present, otherwise falling back to
+// whatever the first published release artifact is.
+func (f *registryFetcher) resolvePyPI(ctx context.Context, name, version string) (url, sha256Hex string, err error) {
+	var meta struct {
+		URLs []struct {
+			URL         string `json:"url"`
+			PackageType string `json:"packagetype"`
+			Digests     struct {
+				SHA256 string `json:"sha256"`
+			} `json:"digests"`
+		} `json:"urls"`
+	}
+
+	if err := f.getJSON(ctx, fmt.Sprintf("https://pypi.org/pypi/%s/%s/json", name, version), &meta); err != nil {
+		return "", "", err
+	}
+	if len(meta.URLs) == 0 {
+		return "", "", fmt.Errorf("pkgfetch: no release artifacts found for pypi package %s@%s", name, version)
+	}
+
+	for _, u := range meta.URLs {
+		if u.PackageType == "sdist" {
+			return u.URL, u.Digests.SHA256, nil
+		}
+	}
+
+	return meta.URLs[0].URL, meta.URLs[0].Digests.SHA256, nil
+}
+
+func (f *registryFetcher) getJSON(ctx context.Context, url string, out interface{}) error {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := f.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pkgfetch: resolving %s: unexpected status %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// npmIntegritySHA512 extracts and hex-decodes the sha512 entry from an npm
+// "dist.integrity" Subresource Integrity string (e.g.
+// "sha512-<base64>"), returning "" if it doesn't contain one, since older
+// packages only publish a sha1 dist.shasum, which verifyChecksum doesn't
+// support.
+func npmIntegritySHA512(integrity string) string {
+	for _, entry := range strings.Fields(integrity) {
+		algo, b64, ok := strings.Cut(entry, "-")
+		if !ok || algo != "sha512" {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			continue
+		}
+		return hex.EncodeToString(raw)
+	}
+	return ""
+}
@@ -0,0 +1,67 @@
+// Package retry implements exponential backoff with full jitter, inspired by
+// github.com/avast/retry-go, for operations that should be attempted a bounded
+// number of times before giving up.
+package retry
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Policy controls how many times an operation is attempted and how long to
+// wait between attempts.
+type Policy struct {
+	// MaxAttempts is the total number of times an operation is attempted,
+	// including the first try.
+	MaxAttempts int
+	// BaseDelay is the upper bound of the jittered backoff before the first
+	// retry; the bound doubles with each later attempt.
+	BaseDelay time.Duration
+	// MaxDelay caps the computed backoff so it never waits longer than this.
+	MaxDelay time.Duration
+}
+
+// DefaultPolicy is a reasonable policy for callers that don't need to tune it.
+var DefaultPolicy = Policy{
+	MaxAttempts: 10,
+	BaseDelay:   time.Second,
+	MaxDelay:    5 * time.Minute,
+}
+
+// Delay returns the backoff to wait before the retry following the given
+// 0-indexed attempt, using full jitter: a uniformly random duration in
+// [0, min(MaxDelay, BaseDelay*2^attempt)).
+func (p Policy) Delay(attempt int) time.Duration {
+	backoff := float64(p.BaseDelay) * math.Pow(2, float64(attempt))
+	if max := float64(p.MaxDelay); max > 0 && backoff > max {
+		backoff = max
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// Do calls fn, which receives the 0-indexed attempt number, until it returns
+// nil or the policy's MaxAttempts is reached, sleeping according to Delay
+// between attempts. It returns the number of attempts made and the last
+// error, or nil if fn eventually succeeded. If ctx is done while waiting
+// between attempts, Do returns early with ctx.Err() instead.
+func Do(ctx context.Context, policy Policy, fn func(attempt int) error) (attempts int, err error) {
+	for attempt := 0; ; attempt++ {
+		err = fn(attempt)
+		if err == nil {
+			return attempt + 1, nil
+		}
+		if attempt+1 >= policy.MaxAttempts {
+			return attempt + 1, err
+		}
+		select {
+		case <-ctx.Done():
+			return attempt + 1, ctx.Err()
+		case <-time.After(policy.Delay(attempt)):
+		}
+	}
+}
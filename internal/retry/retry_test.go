@@ -0,0 +1,122 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPolicyDelayBounds(t *testing.T) {
+	policy := Policy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		want := policy.BaseDelay << attempt
+		if want > policy.MaxDelay {
+			want = policy.MaxDelay
+		}
+
+		for i := 0; i < 50; i++ {
+			d := policy.Delay(attempt)
+			if d < 0 || d > want {
+				t.Fatalf("Delay(%d) = %s, want in [0, %s]", attempt, d, want)
+			}
+		}
+	}
+}
+
+func TestPolicyDelayZeroBaseDelay(t *testing.T) {
+	policy := Policy{MaxDelay: time.Minute}
+	if d := policy.Delay(0); d != 0 {
+		t.Fatalf("Delay(0) = %s, want 0", d)
+	}
+}
+
+func TestDoSucceedsWithoutRetry(t *testing.T) {
+	calls := 0
+	attempts, err := Do(context.Background(), Policy{MaxAttempts: 3}, func(int) error {
+		calls++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do() error = %v, want nil", err)
+	}
+	if attempts != 1 {
+		t.Errorf("attempts = %d, want 1", attempts)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	policy := Policy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	calls := 0
+	attempts, err := Do(context.Background(), policy, func(int) error {
+		calls++
+		if calls < 3 {
+			return errors.New("not yet")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Do() error = %v, want nil", err)
+	}
+	if attempts != 3 {
+		t.Errorf("attempts = %d, want 3", attempts)
+	}
+}
+
+func TestDoStopsAtMaxAttempts(t *testing.T) {
+	policy := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	wantErr := errors.New("always fails")
+	calls := 0
+
+	attempts, err := Do(context.Background(), policy, func(int) error {
+		calls++
+		return wantErr
+	})
+	if !errors.Is(err, wantErr) {
+		t.Fatalf("Do() error = %v, want %v", err, wantErr)
+	}
+	if attempts != policy.MaxAttempts {
+		t.Errorf("attempts = %d, want %d", attempts, policy.MaxAttempts)
+	}
+	if calls != policy.MaxAttempts {
+		t.Errorf("calls = %d, want %d", calls, policy.MaxAttempts)
+	}
+}
+
+func TestDoReturnsContextErrorWhileWaiting(t *testing.T) {
+	policy := Policy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	calls := 0
+	done := make(chan struct{})
+	var attempts int
+	var err error
+	go func() {
+		attempts, err = Do(ctx, policy, func(int) error {
+			calls++
+			return errors.New("fails")
+		})
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Do() did not return promptly after ctx was cancelled")
+	}
+
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Do() error = %v, want context.Canceled", err)
+	}
+	if attempts != 1 {
+		t.Errorf("attempts = %d, want 1", attempts)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}